@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// asnEditionID is the GeoLite2 edition downloaded by fetchASNArchive,
+// independent of whatever EditionID this MaxMind instance is otherwise
+// configured with (City by default).
+const asnEditionID = "GeoLite2-ASN-CSV"
+
+// asnRecord holds the autonomous-system fields parsed from a
+// GeoLite2-ASN-Blocks-IPv{4,6}.csv row.
+type asnRecord struct {
+	ASN    uint32
+	ASNOrg string
+}
+
+// asnBlock is one parsed ASN network range, kept sorted by its starting
+// address so lookups can binary-search for the covering block instead of
+// requiring an exact CIDR match -- ASN blocks are coarser aggregates and
+// rarely share a boundary with the City blocks they're joined against.
+type asnBlock struct {
+	network *net.IPNet
+	start   *big.Int
+	record  asnRecord
+}
+
+// asnBlockIndex is a CIDR-containment index over a set of ASN blocks.
+type asnBlockIndex []asnBlock
+
+// asnDownloadURL builds the license-key-gated download URL for the
+// GeoLite2-ASN-CSV edition, reusing this instance's LicenseKey. There is
+// no anonymous fallback URL for this edition -- MaxMind never published
+// one -- so an empty LicenseKey makes ASN enrichment unavailable.
+func (maxmind *MaxMind) asnDownloadURL() string {
+	if len(maxmind.LicenseKey) < 1 {
+		return ""
+	}
+	values := url.Values{}
+	values.Set("edition_id", asnEditionID)
+	values.Set("license_key", maxmind.LicenseKey)
+	values.Set("suffix", "zip")
+	return maxMindDownloadURL + "?" + values.Encode()
+}
+
+// fetchASNArchive downloads (or reads from cache) and unpacks the
+// GeoLite2-ASN-CSV archive into its own archive slice, separate from the
+// primary EditionID archive, since a City-CSV download never contains
+// the ASN blocks files.
+func (maxmind *MaxMind) fetchASNArchive() error {
+	source := maxmind.asnDownloadURL()
+	if len(source) < 1 {
+		return errors.New("ASN enrichment requires a LicenseKey")
+	}
+	path, err := maxmind.fetchArchive(source)
+	if err != nil {
+		return err
+	}
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	maxmind.asnArchiveFile = reader
+	maxmind.asnArchive = reader.File
+	return nil
+}
+
+// asnBlocks downloads the ASN edition if it hasn't been fetched yet,
+// then reads GeoLite2-ASN-Blocks-IPv{4,6}.csv (columns network,
+// autonomous_system_number, autonomous_system_organization) into a
+// CIDR-containment index.
+func (maxmind *MaxMind) asnBlocks() (asnBlockIndex, error) {
+	if maxmind.asnArchive == nil {
+		if err := maxmind.fetchASNArchive(); err != nil {
+			return nil, err
+		}
+	}
+
+	var blocks asnBlockIndex
+	filename := "GeoLite2-ASN-Blocks-IPv" + strconv.Itoa(maxmind.ipver) + ".csv"
+	for record := range readCSVDatabase(maxmind.asnArchive, filename, "MaxMind", ',', false) {
+		if len(record) < 3 {
+			printMessage("MaxMind", fmt.Sprintf(filename+" too short line: %s", record), "FAIL")
+			continue
+		}
+		_, network, err := net.ParseCIDR(record[0])
+		if err != nil {
+			printMessage("MaxMind", fmt.Sprintf(filename+" bad network %q", record[0]), "FAIL")
+			continue
+		}
+		asn, err := strconv.ParseUint(record[1], 10, 32)
+		if err != nil {
+			printMessage("MaxMind", fmt.Sprintf(filename+" bad ASN %q", record[1]), "FAIL")
+			continue
+		}
+		blocks = append(blocks, asnBlock{
+			network: network,
+			start:   new(big.Int).SetBytes(network.IP),
+			record:  asnRecord{ASN: uint32(asn), ASNOrg: record[2]},
+		})
+	}
+	if len(blocks) < 1 {
+		return nil, errors.New("ASN blocks db is empty")
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].start.Cmp(blocks[j].start) < 0
+	})
+	return blocks, nil
+}
+
+// lookup finds the ASN block containing cidr's network address, by
+// binary-searching for the last block starting at or before it and
+// checking containment -- the longest-prefix match for non-overlapping
+// ASN ranges.
+func (blocks asnBlockIndex) lookup(cidr string) (asnRecord, bool) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return asnRecord{}, false
+	}
+	target := new(big.Int).SetBytes(network.IP)
+
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].start.Cmp(target) > 0
+	}) - 1
+	if i < 0 || !blocks[i].network.Contains(network.IP) {
+		return asnRecord{}, false
+	}
+	return blocks[i].record, true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// geohashAlphabet is the standard base32 geohash character set.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashBits are the bit masks assigned to each of the five bits packed
+// into one base32 character, most significant first.
+var geohashBits = [5]byte{16, 8, 4, 2, 1}
+
+// geohashPrecision is the character length used for mm_geohash.txt,
+// giving sub-meter resolution; lookups can truncate the prefix to widen
+// the search radius.
+const geohashPrecision = 12
+
+// encodeGeohash interleaves lat/lng into a base32 geohash, alternating
+// longitude then latitude one bit per step as is conventional.
+func encodeGeohash(lat, lng float64) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, geohashPrecision)
+	var ch byte
+	bit := 0
+	even := true
+
+	for len(hash) < geohashPrecision {
+		if even {
+			mid := (lngRange[0] + lngRange[1]) / 2
+			if lng > mid {
+				ch |= geohashBits[bit]
+				lngRange[0] = mid
+			} else {
+				lngRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat > mid {
+				ch |= geohashBits[bit]
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashAlphabet[ch])
+			bit = 0
+			ch = 0
+		}
+	}
+	return string(hash)
+}
+
+// geoCoordinate is a city's approximate latitude/longitude, as carried
+// by the network blocks that resolve to it (GeoLite2-City-Locations has
+// no coordinate columns of its own).
+type geoCoordinate struct {
+	Lat float64
+	Lng float64
+}
+
+// cityCoordinates reads GeoLite2-City-Blocks-IPv{4,6}.csv and indexes
+// each geoname ID's latitude/longitude (columns 7/8), keeping the first
+// block seen for a given city since blocks sharing a geoname ID agree
+// closely enough for a reverse-geocode prefix.
+func (maxmind *MaxMind) cityCoordinates() (map[string]geoCoordinate, error) {
+	coords := make(map[string]geoCoordinate)
+	filename := "GeoLite2-City-Blocks-IPv" + strconv.Itoa(maxmind.ipver) + ".csv"
+	for record := range readCSVDatabase(maxmind.archive, filename, "MaxMind", ',', false) {
+		if len(record) < 9 {
+			printMessage("MaxMind", fmt.Sprintf(filename+" too short line for coordinates: %s", record), "FAIL")
+			continue
+		}
+		geoID := record[1]
+		if _, ok := coords[geoID]; ok {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(record[7], 64)
+		lng, errLng := strconv.ParseFloat(record[8], 64)
+		if errLat != nil || errLng != nil {
+			continue
+		}
+		coords[geoID] = geoCoordinate{Lat: lat, Lng: lng}
+	}
+	return coords, nil
+}
+
+// geohashEntry is one city's reverse-geocode index row: its geohash
+// prefix, its geoname ID, and a population tiebreaker for resolving
+// collisions between cities that share a prefix.
+type geohashEntry struct {
+	Geohash    string
+	ID         string
+	Population int
+}
+
+// collectGeohash indexes this pass's coordinates into
+// maxmind.geohashEntries, deduplicating by geoname ID against every
+// entry collected so far -- since writeMap runs once per IP version, the
+// same city can otherwise be seen (and queued twice) in both the IPv4
+// and IPv6 Blocks CSVs. writeGeohashFile sorts and writes the
+// accumulated result once, after both passes have run.
+func (maxmind *MaxMind) collectGeohash(locations map[string]geoItem) error {
+	coords, err := maxmind.cityCoordinates()
+	if err != nil {
+		return err
+	}
+
+	if maxmind.geohashSeen == nil {
+		maxmind.geohashSeen = make(map[string]bool)
+	}
+	for id, coord := range coords {
+		if maxmind.geohashSeen[id] {
+			continue
+		}
+		location, ok := locations[id]
+		if !ok {
+			continue
+		}
+		maxmind.geohashSeen[id] = true
+		maxmind.geohashEntries = append(maxmind.geohashEntries, geohashEntry{
+			Geohash:    encodeGeohash(coord.Lat, coord.Lng),
+			ID:         id,
+			Population: location.Population,
+		})
+	}
+	return nil
+}
+
+// writeGeohashFile sorts every geohash entry accumulated across both
+// IPv4 and IPv6 writeMap passes and writes mm_geohash.txt once, so the
+// whole file -- not just each pass's half -- is globally sorted for the
+// reverse-geocode lookup's binary-search/longest-prefix-match contract.
+// Call it once after all writeMap calls for this run have completed,
+// same as writeMMDBFile.
+func (maxmind *MaxMind) writeGeohashFile() error {
+	entries := maxmind.geohashEntries
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Geohash < entries[j].Geohash
+	})
+
+	file, err := openMapFile(maxmind.OutputDir, "mm_geohash.txt")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, entry := range entries {
+		fmt.Fprintf(file, "%s %s %d;\n", entry.Geohash, entry.ID, entry.Population)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	got := encodeGeohash(57.64911, 10.40744)
+	want := "u4pruydqqvj8"
+	if got != want {
+		t.Fatalf("encodeGeohash(57.64911, 10.40744) = %q, want %q", got, want)
+	}
+}
+
+// TestWriteGeohashFileSortsAcrossPasses is a regression test for a bug
+// where writeGeohash sorted and wrote mm_geohash.txt on every writeMap
+// pass, leaving the file as two independently-sorted blocks (all IPv4
+// cities, then all IPv6 cities) concatenated rather than one
+// globally-sorted file. writeGeohashFile must sort whatever
+// collectGeohash accumulated across both passes before writing.
+func TestWriteGeohashFileSortsAcrossPasses(t *testing.T) {
+	maxmind := &MaxMind{OutputDir: t.TempDir()}
+	// Out-of-order on purpose: this is the shape collectGeohash leaves
+	// behind after an IPv4 pass followed by an IPv6 pass.
+	maxmind.geohashEntries = []geohashEntry{
+		{Geohash: "ezs42", ID: "v4-city", Population: 10},
+		{Geohash: "9q8yy", ID: "v6-city-a", Population: 20},
+		{Geohash: "gbsuv", ID: "v6-city-b", Population: 30},
+	}
+
+	if err := maxmind.writeGeohashFile(); err != nil {
+		t.Fatalf("writeGeohashFile: %v", err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(maxmind.OutputDir, "mm_geohash.txt"))
+	if err != nil {
+		t.Fatalf("reading mm_geohash.txt: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %q", len(lines), raw)
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i-1] > lines[i] {
+			t.Fatalf("mm_geohash.txt is not globally sorted: line %d (%q) > line %d (%q)", i-1, lines[i-1], i, lines[i])
+		}
+	}
+}
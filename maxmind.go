@@ -2,29 +2,57 @@ package main
 
 import (
 	"archive/zip"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// defaultMaxMindURL is used when no custom URL is configured and no
+// license key is available. MaxMind retired this endpoint, so downloads
+// against it will fail; it only exists as a fallback for Edition/URL-less
+// configurations predating license keys.
+const defaultMaxMindURL = "http://geolite.maxmind.com/download/geoip/database/GeoLite2-City-CSV.zip"
+
+// maxMindDownloadURL is the modern license-key-gated download endpoint.
+const maxMindDownloadURL = "https://download.maxmind.com/app/geoip_download"
+
 // MaxMind - GeoBase compatible generator for geolite.maxmind.com
 type MaxMind struct {
-	archive    []*zip.File
-	OutputDir  string
-	ErrorsChan chan Error
-	lang       string
-	ipver      int
-	tzNames    bool
-	include    string
-	exclude    string
-	noBase64   bool
-	noCountry  bool
+	archive          []*zip.File
+	archiveFile      *zip.ReadCloser
+	asnArchive       []*zip.File
+	asnArchiveFile   *zip.ReadCloser
+	OutputDir        string
+	ErrorsChan       chan Error
+	lang             string
+	ipver            int
+	tzNames          bool
+	include          string
+	exclude          string
+	noBase64         bool
+	noCountry        bool
+	mmdb             bool
+	mmdbRecords      []mmdbRecord    // accumulated across IPv4/IPv6 writeMap passes, flushed by writeMMDBFile
+	asn              bool            // set via the -asn/-no-asn CLI flags
+	geohash          bool            // set via the -geohash CLI flag
+	geohashEntries   []geohashEntry  // accumulated across IPv4/IPv6 writeMap passes, flushed by writeGeohashFile
+	geohashSeen      map[string]bool // geoname IDs already queued into geohashEntries
+	LicenseKey       string
+	EditionID        string
+	URL              string
+	PreferRegistered bool
+	lastModified     string
 }
 
 func (maxmind *MaxMind) name() string {
@@ -35,27 +63,163 @@ func (maxmind *MaxMind) addError(err Error) {
 	maxmind.ErrorsChan <- err
 }
 
-func (maxmind *MaxMind) download() ([]byte, error) {
-	resp, err := http.Get("http://geolite.maxmind.com/download/geoip/database/GeoLite2-City-CSV.zip")
+// downloadURL resolves the archive location in priority order: an
+// explicit URL always wins, then a LicenseKey+EditionID pair builds the
+// modern download.maxmind.com endpoint, falling back to the retired
+// anonymous City-CSV URL for backwards compatibility.
+func (maxmind *MaxMind) downloadURL() string {
+	if len(maxmind.URL) > 0 {
+		return maxmind.URL
+	}
+	if len(maxmind.LicenseKey) > 0 {
+		edition := maxmind.EditionID
+		if len(edition) < 1 {
+			edition = "GeoLite2-City-CSV"
+		}
+		values := url.Values{}
+		values.Set("edition_id", edition)
+		values.Set("license_key", maxmind.LicenseKey)
+		values.Set("suffix", "zip")
+		return maxMindDownloadURL + "?" + values.Encode()
+	}
+	return defaultMaxMindURL
+}
+
+// sourceHost strips the query string (which for a license-key download
+// carries the key in cleartext) from source, leaving just enough of the
+// URL to identify which endpoint an error came from.
+func sourceHost(source string) string {
+	if parsed, err := url.Parse(source); err == nil {
+		parsed.RawQuery = ""
+		return parsed.String()
+	}
+	return source
+}
+
+// cachePaths returns the sidecar locations used to avoid re-downloading
+// an unchanged archive fetched from source: the archive bytes themselves
+// and a small metadata file carrying the Last-Modified header.
+func (maxmind *MaxMind) cachePaths(source string) (archive string, meta string) {
+	sum := sha256.Sum256([]byte(source))
+	name := hex.EncodeToString(sum[:8])
+	return filepath.Join(maxmind.OutputDir, "."+name+".maxmind.cache"),
+		filepath.Join(maxmind.OutputDir, "."+name+".maxmind.cache.meta")
+}
+
+// fetchArchive fetches the archive at source to a local path without
+// holding it in memory: local/file:// sources are used in place, and
+// HTTP sources are streamed straight to the cache file on disk. unpack()
+// then opens that path with a ReaderAt, so no single entry needs to be
+// decompressed before the rest of the zip's central directory is even
+// read. Shared by download() (the primary EditionID) and
+// fetchASNArchive() (the separate GeoLite2-ASN-CSV edition).
+func (maxmind *MaxMind) fetchArchive(source string) (string, error) {
+	if strings.HasPrefix(source, "file://") {
+		return strings.TrimPrefix(source, "file://"), nil
+	}
+	if !strings.Contains(source, "://") {
+		return source, nil
+	}
+
+	archivePath, metaPath := maxmind.cachePaths(source)
+	cachedModified := ""
+	if data, err := ioutil.ReadFile(metaPath); err == nil {
+		cachedModified = strings.TrimSpace(string(data))
+	}
+
+	get := func(ifModifiedSince string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", source, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(ifModifiedSince) > 0 {
+			req.Header.Set("If-Modified-Since", ifModifiedSince)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := get(cachedModified)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer resp.Body.Close()
-	answer, err := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusNotModified {
+		if _, err := os.Stat(archivePath); err == nil {
+			return archivePath, nil
+		}
+		// The cached archive went missing: the 304 body is empty, so
+		// re-issue the request without If-Modified-Since instead of
+		// writing that empty body out as the archive.
+		resp.Body.Close()
+		resp, err = get("")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: unexpected HTTP status %s", sourceHost(source), resp.Status)
+	}
+
+	out, err := os.Create(archivePath)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return "", err
 	}
-	return answer, nil
+	out.Close()
+
+	if lastModified := resp.Header.Get("Last-Modified"); len(lastModified) > 0 {
+		maxmind.lastModified = lastModified
+		_ = ioutil.WriteFile(metaPath, []byte(lastModified), 0644)
+	}
+
+	return archivePath, nil
 }
 
-func (maxmind *MaxMind) unpack(response []byte) error {
-	file, err := Unpack(response)
-	if err == nil {
-		maxmind.archive = file
+// download fetches the primary EditionID's archive (City/Country/etc.,
+// as configured on this MaxMind instance) to a local path.
+func (maxmind *MaxMind) download() (string, error) {
+	return maxmind.fetchArchive(maxmind.downloadURL())
+}
+
+// unpack opens path as a zip archive backed by the file itself rather
+// than an in-memory buffer, so entries are only decompressed as
+// readCSVDatabase reads from them.
+func (maxmind *MaxMind) unpack(path string) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	maxmind.archiveFile = reader
+	maxmind.archive = reader.File
+	return nil
+}
+
+// close releases the archive file handles opened by unpack and
+// fetchASNArchive.
+func (maxmind *MaxMind) close() error {
+	var err error
+	if maxmind.archiveFile != nil {
+		err = maxmind.archiveFile.Close()
+	}
+	if maxmind.asnArchiveFile != nil {
+		if closeErr := maxmind.asnArchiveFile.Close(); err == nil {
+			err = closeErr
+		}
 	}
 	return err
 }
 
+// lineToItem parses one GeoLite2-City-Locations-<lang>.csv row. A row
+// with no city_name (record[10]) is still kept, not dropped -- those are
+// the country-only geoname rows that registered_country_geoname_id and
+// represented_country_geoname_id point to in the Blocks CSVs, and
+// resolveLocation needs them present in the locations map to resolve its
+// fallback.
 func (maxmind *MaxMind) lineToItem(record []string, currentTime time.Time) (*string, *geoItem, string, error) {
 	if len(record) < 13 {
 		return nil, nil, "FAIL", errors.New("too short line")
@@ -74,9 +238,6 @@ func (maxmind *MaxMind) lineToItem(record []string, currentTime time.Time) (*str
 	if !maxmind.tzNames {
 		tz = convertTZToOffset(currentTime, record[12])
 	}
-	if len(record[10]) < 1 {
-		return nil, nil, "", errors.New("too short city name")
-	}
 	return &record[0], &geoItem{
 		ID:          record[0],
 		City:        record[10],
@@ -86,6 +247,32 @@ func (maxmind *MaxMind) lineToItem(record []string, currentTime time.Time) (*str
 	}, "", nil
 }
 
+// resolveLocation finds a location for a GeoLite2-City-Blocks-IPv{4,6}.csv
+// row, trying its own geoname_id (record[1]) first, then falling back to
+// the registered_country_geoname_id (record[2]) and
+// represented_country_geoname_id (record[3]) -- each itself a geoname ID
+// looked up in the same locations map -- when the primary entry is
+// missing or was dropped by lineToItem for lacking country data. This is
+// the common case for satellite ranges, EU aggregations, and military
+// networks that only carry a country through one of those references.
+// PreferRegistered swaps the first two so operators who care about legal
+// jurisdiction get that answer instead of the geographic one.
+func (maxmind *MaxMind) resolveLocation(record []string, locations map[string]geoItem) (geoItem, bool) {
+	primary, registered, represented := record[1], record[2], record[3]
+	if maxmind.PreferRegistered {
+		primary, registered = registered, primary
+	}
+	for _, id := range []string{primary, registered, represented} {
+		if len(id) < 1 {
+			continue
+		}
+		if location, ok := locations[id]; ok && len(location.CountryCode) > 0 {
+			return location, true
+		}
+	}
+	return geoItem{}, false
+}
+
 func (maxmind *MaxMind) citiesDB() (map[string]geoItem, error) {
 	locations := make(map[string]geoItem)
 	currentTime := time.Now()
@@ -106,14 +293,17 @@ func (maxmind *MaxMind) citiesDB() (map[string]geoItem, error) {
 	return locations, nil
 }
 
-func (maxmind *MaxMind) parseNetwork(locations map[string]geoItem) <-chan geoItem {
+// parseNetwork joins the City-Blocks rows onto locations via
+// resolveLocation, and, when asnBlocks is non-nil, additionally joins
+// the same network's ASN and organization by CIDR containment so a
+// single pass can feed every output file.
+func (maxmind *MaxMind) parseNetwork(locations map[string]geoItem, asnBlocks asnBlockIndex) <-chan geoItem {
 	database := make(chan geoItem)
 	go func() {
 		var ipRange string
-		var geoID string
 		filename := "GeoLite2-City-Blocks-IPv" + strconv.Itoa(maxmind.ipver) + ".csv"
 		for record := range readCSVDatabase(maxmind.archive, filename, "MaxMind", ',', false) {
-			if len(record) < 2 {
+			if len(record) < 4 {
 				printMessage("MaxMind", fmt.Sprintf(filename+" too short line: %s", record), "FAIL")
 				continue
 			}
@@ -121,9 +311,12 @@ func (maxmind *MaxMind) parseNetwork(locations map[string]geoItem) <-chan geoIte
 			if ipRange == "" {
 				continue
 			}
-			geoID = record[1]
-			if location, ok := locations[geoID]; ok {
+			if location, ok := maxmind.resolveLocation(record, locations); ok {
 				location.Network = ipRange
+				if asn, ok := asnBlocks.lookup(record[0]); ok {
+					location.ASN = asn.ASN
+					location.ASNOrg = asn.ASNOrg
+				}
 				database <- location
 			}
 		}
@@ -141,6 +334,9 @@ func (maxmind *MaxMind) writeMap(locations map[string]geoItem) error {
 	if err != nil {
 		return err
 	}
+	defer city.Close()
+	defer tz.Close()
+
 	var country *os.File
 	var countryCode *os.File
 	if !maxmind.noCountry {
@@ -155,10 +351,27 @@ func (maxmind *MaxMind) writeMap(locations map[string]geoItem) error {
 		defer country.Close()
 		defer countryCode.Close()
 	}
-	defer city.Close()
-	defer tz.Close()
+	var asn *os.File
+	var asnOrg *os.File
+	var asnBlocks asnBlockIndex
+	if maxmind.asn {
+		asnBlocks, err = maxmind.asnBlocks()
+		if err != nil {
+			return err
+		}
+		asn, err = openMapFile(maxmind.OutputDir, "mm_asn.txt")
+		if err != nil {
+			return err
+		}
+		asnOrg, err = openMapFile(maxmind.OutputDir, "mm_asn_org.txt")
+		if err != nil {
+			return err
+		}
+		defer asn.Close()
+		defer asnOrg.Close()
+	}
 
-	for location := range maxmind.parseNetwork(locations) {
+	for location := range maxmind.parseNetwork(locations, asnBlocks) {
 		var cityName string
 		var countryName string
 		if maxmind.noBase64 {
@@ -175,6 +388,32 @@ func (maxmind *MaxMind) writeMap(locations map[string]geoItem) error {
 			fmt.Fprintf(country, "%s %s;\n", location.Network, countryName)
 			fmt.Fprintf(countryCode, "%s %s;\n", location.Network, location.CountryCode)
 		}
+		if maxmind.asn {
+			var orgName string
+			if maxmind.noBase64 {
+				orgName = "\"" + strings.Replace(location.ASNOrg, "\"", "\\\"", -1) + "\""
+			} else {
+				orgName = base64.StdEncoding.EncodeToString([]byte(location.ASNOrg))
+			}
+			fmt.Fprintf(asn, "%s %d;\n", location.Network, location.ASN)
+			fmt.Fprintf(asnOrg, "%s %s;\n", location.Network, orgName)
+		}
+		if maxmind.mmdb {
+			maxmind.mmdbRecords = append(maxmind.mmdbRecords, mmdbRecord{
+				Network:     location.Network,
+				City:        location.City,
+				Country:     location.Country,
+				CountryCode: location.CountryCode,
+				TZ:          location.TZ,
+				IPVer:       maxmind.ipver,
+			})
+		}
+	}
+
+	if maxmind.geohash {
+		if err := maxmind.collectGeohash(locations); err != nil {
+			return err
+		}
 	}
 	return nil
 }
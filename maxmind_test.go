@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// TestResolveLocationCountryOnlyFallback checks that resolveLocation
+// falls back to a country-only locations entry (no City) -- the shape of
+// the geoname rows that registered_country_geoname_id and
+// represented_country_geoname_id point to, which lineToItem keeps.
+func TestResolveLocationCountryOnlyFallback(t *testing.T) {
+	locations := map[string]geoItem{
+		"5128581": {ID: "5128581", City: "New York", Country: "United States", CountryCode: "US"},
+		"6252001": {ID: "6252001", Country: "United States", CountryCode: "US"}, // country-only: no City
+	}
+	maxmind := &MaxMind{}
+
+	// record[1]=own geoname_id (missing), record[2]=registered_country_geoname_id
+	record := []string{"1.2.3.0/24", "", "6252001", ""}
+	location, ok := maxmind.resolveLocation(record, locations)
+	if !ok {
+		t.Fatalf("expected resolveLocation to fall back to the registered country")
+	}
+	if location.CountryCode != "US" {
+		t.Fatalf("got country code %q, want %q", location.CountryCode, "US")
+	}
+}
+
+func TestResolveLocationPreferRegistered(t *testing.T) {
+	locations := map[string]geoItem{
+		"own": {CountryCode: "DE"},
+		"reg": {CountryCode: "FR"},
+	}
+	maxmind := &MaxMind{PreferRegistered: true}
+	record := []string{"", "own", "reg", ""}
+	location, ok := maxmind.resolveLocation(record, locations)
+	if !ok || location.CountryCode != "FR" {
+		t.Fatalf("PreferRegistered should prefer the registered country, got %q ok=%v", location.CountryCode, ok)
+	}
+}
+
+func TestResolveLocationNoMatch(t *testing.T) {
+	maxmind := &MaxMind{}
+	location, ok := maxmind.resolveLocation([]string{"1.2.3.0/24", "", "", ""}, map[string]geoItem{})
+	if ok {
+		t.Fatalf("expected no match, got %+v", location)
+	}
+}
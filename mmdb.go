@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// MMDB data section type tags, per the MaxMind DB file format spec.
+const (
+	mmdbTypePointer = 1
+	mmdbTypeString  = 2
+	mmdbTypeUint16  = 5
+	mmdbTypeUint32  = 6
+	mmdbTypeMap     = 7
+	mmdbTypeUint64  = 9
+	mmdbTypeArray   = 11
+)
+
+// mmdbMetadataMarker prefixes the metadata section so readers can find it
+// by scanning backwards from the end of the file.
+var mmdbMetadataMarker = []byte{0xab, 0xcd, 0xef, 'M', 'a', 'x', 'M', 'i', 'n', 'd', '.', 'c', 'o', 'm'}
+
+// mmdbDataSectionSeparatorSize is the width of the all-zero separator
+// between the search tree and the data section, per the MMDB spec. A
+// data-section pointer's value is nodeCount + this size + the stored
+// offset, since the spec defines the data section as starting that far
+// past the tree regardless of record_size.
+const mmdbDataSectionSeparatorSize = 16
+
+// mmdbEncoder appends MaxMind DB data-section values to a buffer,
+// deduplicating repeated strings and scalars by their encoded bytes so
+// the handful of distinct city/country/time-zone names shared across
+// millions of networks are stored once.
+type mmdbEncoder struct {
+	buf   bytes.Buffer
+	cache map[string]int
+}
+
+func newMMDBEncoder() *mmdbEncoder {
+	return &mmdbEncoder{cache: make(map[string]int)}
+}
+
+// writeControl emits a control byte for dataType and size. Types above 7
+// (uint64, array) are extended: the control byte's type field is 0 and
+// the type minus 7 follows in the next byte, ahead of any size bytes.
+func (e *mmdbEncoder) writeControl(dataType byte, size int) {
+	typeBits, extended := dataType, byte(0)
+	if dataType > 7 {
+		typeBits, extended = 0, dataType-7
+	}
+	var sizeBits byte
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, sizeBytes = 29, []byte{byte(size - 29)}
+	case size < 65821:
+		extra := size - 285
+		sizeBits, sizeBytes = 30, []byte{byte(extra >> 8), byte(extra)}
+	default:
+		extra := size - 65821
+		sizeBits, sizeBytes = 31, []byte{byte(extra >> 16), byte(extra >> 8), byte(extra)}
+	}
+	e.buf.WriteByte(typeBits<<5 | sizeBits)
+	if extended > 0 {
+		e.buf.WriteByte(extended)
+	}
+	e.buf.Write(sizeBytes)
+}
+
+// dedup returns the offset of a previously encoded value for key, writing
+// it via encode and caching the result on first use.
+func (e *mmdbEncoder) dedup(key string, encode func()) int {
+	if off, ok := e.cache[key]; ok {
+		return off
+	}
+	off := e.buf.Len()
+	encode()
+	e.cache[key] = off
+	return off
+}
+
+func (e *mmdbEncoder) putString(s string) int {
+	return e.dedup("s:"+s, func() {
+		e.writeControl(mmdbTypeString, len(s))
+		e.buf.WriteString(s)
+	})
+}
+
+func (e *mmdbEncoder) putUint16(v uint16) int {
+	return e.dedup("u16:"+strconv.Itoa(int(v)), func() {
+		e.writeControl(mmdbTypeUint16, 2)
+		e.buf.WriteByte(byte(v >> 8))
+		e.buf.WriteByte(byte(v))
+	})
+}
+
+func (e *mmdbEncoder) putUint32(v uint32) int {
+	return e.dedup("u32:"+strconv.Itoa(int(v)), func() {
+		e.writeControl(mmdbTypeUint32, 4)
+		e.buf.WriteByte(byte(v >> 24))
+		e.buf.WriteByte(byte(v >> 16))
+		e.buf.WriteByte(byte(v >> 8))
+		e.buf.WriteByte(byte(v))
+	})
+}
+
+func (e *mmdbEncoder) putUint64(v uint64) int {
+	off := e.buf.Len()
+	e.writeControl(mmdbTypeUint64, 8)
+	for shift := 56; shift >= 0; shift -= 8 {
+		e.buf.WriteByte(byte(v >> uint(shift)))
+	}
+	return off
+}
+
+// putPointer emits a reference to a value already written at offset, so
+// the map/array entries below can share a single copy of a string.
+func (e *mmdbEncoder) putPointer(offset int) {
+	e.buf.WriteByte(mmdbTypePointer<<5 | 0x18) // size=3: next 4 bytes are the full offset
+	e.buf.WriteByte(byte(offset >> 24))
+	e.buf.WriteByte(byte(offset >> 16))
+	e.buf.WriteByte(byte(offset >> 8))
+	e.buf.WriteByte(byte(offset))
+}
+
+func (e *mmdbEncoder) putMap(pairs [][2]int) int {
+	off := e.buf.Len()
+	e.writeControl(mmdbTypeMap, len(pairs))
+	for _, pair := range pairs {
+		e.putPointer(pair[0])
+		e.putPointer(pair[1])
+	}
+	return off
+}
+
+func (e *mmdbEncoder) putArray(items []int) int {
+	off := e.buf.Len()
+	e.writeControl(mmdbTypeArray, len(items))
+	for _, item := range items {
+		e.putPointer(item)
+	}
+	return off
+}
+
+// mmdbMetaPair is one key/value entry of an inline-encoded metadata map;
+// Value writes the value bytes directly rather than via a pointer.
+type mmdbMetaPair struct {
+	Key   string
+	Value func(*mmdbEncoder)
+}
+
+// writeInlineString/Uint16/Uint32/Uint64/Map/Array encode values nested
+// directly in document order (no offsets, no dedup), used only for the
+// metadata section. A reader decodes the single value immediately
+// following mmdbMetadataMarker, so that value -- the root map -- must be
+// the very first bytes written, with every nested value following it in
+// place; putMap's pointer indirection (meant for the deduplicated main
+// data section) would put the map's own bytes last instead.
+func (e *mmdbEncoder) writeInlineString(s string) {
+	e.writeControl(mmdbTypeString, len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *mmdbEncoder) writeInlineUint16(v uint16) {
+	e.writeControl(mmdbTypeUint16, 2)
+	e.buf.WriteByte(byte(v >> 8))
+	e.buf.WriteByte(byte(v))
+}
+
+func (e *mmdbEncoder) writeInlineUint32(v uint32) {
+	e.writeControl(mmdbTypeUint32, 4)
+	e.buf.WriteByte(byte(v >> 24))
+	e.buf.WriteByte(byte(v >> 16))
+	e.buf.WriteByte(byte(v >> 8))
+	e.buf.WriteByte(byte(v))
+}
+
+func (e *mmdbEncoder) writeInlineUint64(v uint64) {
+	e.writeControl(mmdbTypeUint64, 8)
+	for shift := 56; shift >= 0; shift -= 8 {
+		e.buf.WriteByte(byte(v >> uint(shift)))
+	}
+}
+
+func (e *mmdbEncoder) writeInlineMap(pairs []mmdbMetaPair) {
+	e.writeControl(mmdbTypeMap, len(pairs))
+	for _, pair := range pairs {
+		e.writeInlineString(pair.Key)
+		pair.Value(e)
+	}
+}
+
+func (e *mmdbEncoder) writeInlineArray(items []func(*mmdbEncoder)) {
+	e.writeControl(mmdbTypeArray, len(items))
+	for _, item := range items {
+		item(e)
+	}
+}
+
+// mmdbTrieNode is one binary-trie node covering a single bit of the IP
+// address. A terminal prefix is recorded directly on the parent's edge
+// (data[bit]) rather than as its own node, matching how the MMDB tree
+// format distinguishes "keep descending" from "record found here".
+type mmdbTrieNode struct {
+	index   int
+	child   [2]*mmdbTrieNode
+	hasData [2]bool
+	data    [2]int
+}
+
+type mmdbTrie struct {
+	root  *mmdbTrieNode
+	depth int
+}
+
+func newMMDBTrie(depth int) *mmdbTrie {
+	return &mmdbTrie{root: &mmdbTrieNode{}, depth: depth}
+}
+
+func (t *mmdbTrie) insert(ip net.IP, prefixLen int, dataOffset int) {
+	node := t.root
+	for depth := 0; depth < prefixLen; depth++ {
+		byteIndex := depth / 8
+		bit := int(ip[byteIndex]>>(7-uint(depth%8))) & 1
+		if depth == prefixLen-1 {
+			node.hasData[bit] = true
+			node.data[bit] = dataOffset
+			node.child[bit] = nil
+			continue
+		}
+		if node.child[bit] == nil {
+			node.child[bit] = &mmdbTrieNode{}
+		}
+		node = node.child[bit]
+	}
+}
+
+// flatten numbers every node in pre-order, which is all the tree encoding
+// needs: any numbering consistent with the child pointers is valid.
+func (t *mmdbTrie) flatten() []*mmdbTrieNode {
+	var nodes []*mmdbTrieNode
+	var visit func(n *mmdbTrieNode)
+	visit = func(n *mmdbTrieNode) {
+		n.index = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil {
+				visit(c)
+			}
+		}
+	}
+	visit(t.root)
+	return nodes
+}
+
+// ipv4InIPv6 embeds a 4-byte IPv4 address under the all-zero ::/96 prefix
+// expected by MMDB readers (e.g. oschwald/maxminddb-golang), which locate
+// the IPv4 start node by walking 96 zero bits from the tree root. This is
+// deliberately not net.IP.To16(), which produces the ::ffff:a.b.c.d
+// mapped form (bytes 10-11 set to 0xff) and would place every IPv4 record
+// at the wrong node in a mixed IPv4+IPv6 tree.
+func ipv4InIPv6(v4 net.IP) net.IP {
+	embedded := make(net.IP, net.IPv6len)
+	copy(embedded[12:], v4)
+	return embedded
+}
+
+// mmdbRecord is one CIDR block's worth of enriched location data, ready
+// to be written into the MMDB data section. IPVer records which pass
+// (-4 or -6) produced it, since writeMMDBFile accumulates records across
+// both before building a single tree.
+type mmdbRecord struct {
+	Network     string
+	City        string
+	Country     string
+	CountryCode string
+	TZ          string
+	IPVer       int
+}
+
+// writeMMDBFile builds a MaxMind DB binary (record_size=24) from every
+// record accumulated in maxmind.mmdbRecords across both the IPv4 and
+// IPv6 writeMap passes, and writes it to OutputDir/mm_city.mmdb, so
+// services already using maxminddb-golang/geoip2-golang can read this
+// generator's output directly instead of parsing the text maps. Call it
+// once after all writeMap calls for this run have completed -- calling
+// it per pass would overwrite the file with only the last family's
+// records.
+func (maxmind *MaxMind) writeMMDBFile() error {
+	records := maxmind.mmdbRecords
+	depth := 32
+	for _, record := range records {
+		if record.IPVer == 6 {
+			depth = 128
+			break
+		}
+	}
+	trie := newMMDBTrie(depth)
+	data := newMMDBEncoder()
+
+	for _, record := range records {
+		_, network, err := net.ParseCIDR(record.Network)
+		if err != nil {
+			continue
+		}
+		ip := network.IP
+		prefixLen, _ := network.Mask.Size()
+		if depth == 128 {
+			if record.IPVer == 4 {
+				v4 := ip.To4()
+				if v4 == nil {
+					continue
+				}
+				prefixLen += 96
+				ip = ipv4InIPv6(v4)
+			} else {
+				ip = ip.To16()
+			}
+		} else {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			continue
+		}
+
+		cityOff := data.putString(record.City)
+		countryOff := data.putString(record.Country)
+		isoOff := data.putString(record.CountryCode)
+		tzOff := data.putString(record.TZ)
+		keyCity := data.putString("city")
+		keyCountry := data.putString("country")
+		keyISO := data.putString("iso_code")
+		keyTZ := data.putString("time_zone")
+
+		recordOff := data.putMap([][2]int{
+			{keyCity, cityOff},
+			{keyCountry, countryOff},
+			{keyISO, isoOff},
+			{keyTZ, tzOff},
+		})
+
+		trie.insert(ip, prefixLen, recordOff)
+	}
+
+	nodes := trie.flatten()
+	nodeCount := len(nodes)
+
+	var tree bytes.Buffer
+	writeRecordValue := func(buf *bytes.Buffer, value int) {
+		buf.WriteByte(byte(value >> 16))
+		buf.WriteByte(byte(value >> 8))
+		buf.WriteByte(byte(value))
+	}
+	for _, node := range nodes {
+		for _, bit := range []int{0, 1} {
+			switch {
+			case node.child[bit] != nil:
+				writeRecordValue(&tree, node.child[bit].index)
+			case node.hasData[bit]:
+				writeRecordValue(&tree, nodeCount+mmdbDataSectionSeparatorSize+node.data[bit])
+			default:
+				writeRecordValue(&tree, nodeCount)
+			}
+		}
+	}
+
+	meta := newMMDBEncoder()
+	meta.writeInlineMap([]mmdbMetaPair{
+		{"binary_format_major_version", func(e *mmdbEncoder) { e.writeInlineUint16(2) }},
+		{"binary_format_minor_version", func(e *mmdbEncoder) { e.writeInlineUint16(0) }},
+		{"build_epoch", func(e *mmdbEncoder) { e.writeInlineUint64(0) }},
+		{"database_type", func(e *mmdbEncoder) { e.writeInlineString("GeoLite2-City") }},
+		{"description", func(e *mmdbEncoder) {
+			e.writeInlineMap([]mmdbMetaPair{
+				{maxmind.lang, func(e *mmdbEncoder) { e.writeInlineString("ip2geo generated city database") }},
+			})
+		}},
+		{"ip_version", func(e *mmdbEncoder) {
+			ipVersion := uint16(4)
+			if depth == 128 {
+				ipVersion = 6
+			}
+			e.writeInlineUint16(ipVersion)
+		}},
+		{"languages", func(e *mmdbEncoder) {
+			e.writeInlineArray([]func(*mmdbEncoder){
+				func(e *mmdbEncoder) { e.writeInlineString(maxmind.lang) },
+			})
+		}},
+		{"node_count", func(e *mmdbEncoder) { e.writeInlineUint32(uint32(nodeCount)) }},
+		{"record_size", func(e *mmdbEncoder) { e.writeInlineUint16(24) }},
+	})
+
+	out, err := os.Create(filepath.Join(maxmind.OutputDir, "mm_city.mmdb"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := tree.WriteTo(out); err != nil {
+		return err
+	}
+	if _, err := out.Write(make([]byte, mmdbDataSectionSeparatorSize)); err != nil {
+		return err
+	}
+	if _, err := data.buf.WriteTo(out); err != nil {
+		return err
+	}
+	if _, err := out.Write(mmdbMetadataMarker); err != nil {
+		return err
+	}
+	_, err = meta.buf.WriteTo(out)
+	return err
+}
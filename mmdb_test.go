@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPv4InIPv6(t *testing.T) {
+	v4 := net.ParseIP("203.0.113.9").To4()
+	embedded := ipv4InIPv6(v4)
+	for i := 0; i < 12; i++ {
+		if embedded[i] != 0 {
+			t.Fatalf("expected zero byte at index %d, got %#x", i, embedded[i])
+		}
+	}
+	if !bytes.Equal(embedded[12:], v4) {
+		t.Fatalf("expected last 4 bytes %v, got %v", v4, embedded[12:])
+	}
+}
+
+// TestWriteMMDBFileMixedFamily is a regression test for a bug where IPv4
+// records in a mixed IPv4+IPv6 tree were embedded via net.IP.To16() (the
+// ::ffff:a.b.c.d mapped form) instead of under the all-zero ::/96 prefix
+// MMDB readers expect, making every IPv4 lookup against the produced
+// mm_city.mmdb miss. It round-trips writeMMDBFile's output through a
+// minimal decoder and confirms both address families resolve.
+func TestWriteMMDBFileMixedFamily(t *testing.T) {
+	maxmind := &MaxMind{
+		OutputDir: t.TempDir(),
+		lang:      "en",
+		mmdbRecords: []mmdbRecord{
+			{Network: "203.0.113.0/24", City: "Springfield", Country: "United States", CountryCode: "US", TZ: "America/Chicago", IPVer: 4},
+			{Network: "2001:db8::/32", City: "Berlin", Country: "Germany", CountryCode: "DE", TZ: "Europe/Berlin", IPVer: 6},
+		},
+	}
+	if err := maxmind.writeMMDBFile(); err != nil {
+		t.Fatalf("writeMMDBFile: %v", err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(maxmind.OutputDir, "mm_city.mmdb"))
+	if err != nil {
+		t.Fatalf("reading mm_city.mmdb: %v", err)
+	}
+
+	nodeCount := decodeNodeCount(t, raw)
+
+	v4Lookup := ipv4InIPv6(net.ParseIP("203.0.113.9").To4())
+	if city := lookupCity(t, raw, nodeCount, v4Lookup); city != "Springfield" {
+		t.Fatalf("IPv4 lookup under ::/96: got city %q, want %q", city, "Springfield")
+	}
+
+	v6Lookup := net.ParseIP("2001:db8::1")
+	if city := lookupCity(t, raw, nodeCount, v6Lookup); city != "Berlin" {
+		t.Fatalf("IPv6 lookup: got city %q, want %q", city, "Berlin")
+	}
+}
+
+// The helpers below are a deliberately minimal re-implementation of the
+// MMDB control-byte/tree decoding, just enough to verify writeMMDBFile's
+// output against a real reader's layout assumptions, independent of the
+// encoder under test.
+
+func decodeControl(t *testing.T, buf []byte, pos int) (dataType byte, size int, next int) {
+	t.Helper()
+	b := buf[pos]
+	dataType = b >> 5
+	low := int(b & 0x1f)
+	pos++
+	if dataType == 0 {
+		dataType = 7 + buf[pos]
+		pos++
+	}
+	switch {
+	case low < 29:
+		size = low
+	case low == 29:
+		size = 29 + int(buf[pos])
+		pos++
+	case low == 30:
+		size = 285 + int(buf[pos])<<8 + int(buf[pos+1])
+		pos += 2
+	default:
+		size = 65821 + int(buf[pos])<<16 + int(buf[pos+1])<<8 + int(buf[pos+2])
+		pos += 3
+	}
+	return dataType, size, pos
+}
+
+func decodePointer(t *testing.T, buf []byte, pos int) (offset int, next int) {
+	t.Helper()
+	if buf[pos]>>5 != mmdbTypePointer {
+		t.Fatalf("expected pointer at offset %d, got type %d", pos, buf[pos]>>5)
+	}
+	pos++
+	offset = int(buf[pos])<<24 | int(buf[pos+1])<<16 | int(buf[pos+2])<<8 | int(buf[pos+3])
+	return offset, pos + 4
+}
+
+func decodeString(t *testing.T, buf []byte, pos int) string {
+	t.Helper()
+	dataType, size, next := decodeControl(t, buf, pos)
+	if dataType != mmdbTypeString {
+		t.Fatalf("expected string at offset %d, got type %d", pos, dataType)
+	}
+	return string(buf[next : next+size])
+}
+
+// decodeInlineValue decodes a value written by writeInlineMap/Array/etc.
+// (no pointer indirection), used for the metadata section only.
+func decodeInlineValue(t *testing.T, buf []byte, pos int) (interface{}, int) {
+	t.Helper()
+	dataType, size, next := decodeControl(t, buf, pos)
+	switch dataType {
+	case mmdbTypeString:
+		return string(buf[next : next+size]), next + size
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		var v uint64
+		for i := 0; i < size; i++ {
+			v = v<<8 | uint64(buf[next+i])
+		}
+		return v, next + size
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		p := next
+		for i := 0; i < size; i++ {
+			var key interface{}
+			key, p = decodeInlineValue(t, buf, p)
+			var val interface{}
+			val, p = decodeInlineValue(t, buf, p)
+			m[key.(string)] = val
+		}
+		return m, p
+	case mmdbTypeArray:
+		arr := make([]interface{}, size)
+		p := next
+		for i := 0; i < size; i++ {
+			arr[i], p = decodeInlineValue(t, buf, p)
+		}
+		return arr, p
+	default:
+		t.Fatalf("unsupported inline type %d at offset %d", dataType, pos)
+		return nil, 0
+	}
+}
+
+func findMetadataMarker(buf []byte) int {
+	for i := len(buf) - len(mmdbMetadataMarker); i >= 0; i-- {
+		if bytes.Equal(buf[i:i+len(mmdbMetadataMarker)], mmdbMetadataMarker) {
+			return i
+		}
+	}
+	return -1
+}
+
+func decodeNodeCount(t *testing.T, raw []byte) int {
+	t.Helper()
+	markerPos := findMetadataMarker(raw)
+	if markerPos < 0 {
+		t.Fatalf("metadata marker not found")
+	}
+	value, _ := decodeInlineValue(t, raw, markerPos+len(mmdbMetadataMarker))
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		t.Fatalf("metadata section did not start with the root map")
+	}
+	return int(meta["node_count"].(uint64))
+}
+
+func readRecordValue(tree []byte, node, bit int) int {
+	start := node*6 + bit*3
+	return int(tree[start])<<16 | int(tree[start+1])<<8 | int(tree[start+2])
+}
+
+func walkTree(tree []byte, nodeCount int, ip net.IP) (int, bool) {
+	node := 0
+	for bitIndex := 0; bitIndex < len(ip)*8; bitIndex++ {
+		byteIndex := bitIndex / 8
+		bit := int(ip[byteIndex]>>(7-uint(bitIndex%8))) & 1
+		value := readRecordValue(tree, node, bit)
+		switch {
+		case value == nodeCount:
+			return 0, false
+		case value > nodeCount:
+			return value - nodeCount - mmdbDataSectionSeparatorSize, true
+		default:
+			node = value
+		}
+	}
+	return 0, false
+}
+
+func lookupCity(t *testing.T, raw []byte, nodeCount int, ip net.IP) string {
+	t.Helper()
+	treeSize := nodeCount * 6
+	dataOffset, found := walkTree(raw[:treeSize], nodeCount, ip)
+	if !found {
+		t.Fatalf("no data found for %v", ip)
+	}
+	data := raw[treeSize+mmdbDataSectionSeparatorSize:]
+
+	dataType, size, pos := decodeControl(t, data, dataOffset)
+	if dataType != mmdbTypeMap {
+		t.Fatalf("expected record map at data offset %d, got type %d", dataOffset, dataType)
+	}
+	for i := 0; i < size; i++ {
+		keyOff, afterKey := decodePointer(t, data, pos)
+		valOff, afterVal := decodePointer(t, data, afterKey)
+		pos = afterVal
+		if decodeString(t, data, keyOff) == "city" {
+			return decodeString(t, data, valOff)
+		}
+	}
+	t.Fatalf("record map has no city key")
+	return ""
+}